@@ -0,0 +1,346 @@
+// Package fake provides an in-memory implementation of azure.AzureProvider,
+// so AzureCredentialsMinter's mint/delete/assign/rotate logic can be unit
+// tested without a live Azure tenant. It is a hand-written substitute for a
+// generated mock: this tree vendors no mocking library, and modeling real
+// create/list/delete semantics here exercises minter.go's retry and listing
+// paths (e.g. RoleAssignmentExists, PrincipalNotFound, tag-scoped listing)
+// more faithfully than a recorded-call mock would. Results are not paged.
+package fake
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/authorization/armauthorization"
+	"github.com/Azure/go-autorest/autorest/to"
+	guuid "github.com/google/uuid"
+	"github.com/microsoftgraph/msgraph-sdk-go/models"
+)
+
+// operatorOwnedTag mirrors azure.operatorOwnedTag (see provider_graph.go):
+// the tag the production provider stamps on every application it creates.
+// CreateApplication sets it here too, so ListAllApplications can filter the
+// same way graphAzureProvider.ListAllApplications does via its tags/any()
+// filter, instead of returning every application the fake holds.
+const operatorOwnedTag = "owner=cloud-credential-operator"
+
+// roleAssignment pairs an armauthorization.RoleAssignment with the scope it
+// was created at, since the SDK type itself doesn't carry its scope.
+type roleAssignment struct {
+	scope      string
+	assignment *armauthorization.RoleAssignment
+}
+
+// Provider is an in-memory azure.AzureProvider. The zero value is not usable;
+// construct one with NewProvider. It is safe for concurrent use.
+type Provider struct {
+	mu sync.Mutex
+
+	nextID int
+
+	applications      map[string]*models.Application
+	servicePrincipals map[string]*models.ServicePrincipal
+	roleDefinitions   map[string][]*armauthorization.RoleDefinition
+	roleAssignments   map[string]roleAssignment
+
+	// PendingPrincipalNotFound simulates AAD directory replication lag:
+	// CreateRoleAssignment for a principalID present here returns a
+	// PrincipalNotFound error and decrements the counter, until it reaches
+	// zero, at which point the assignment succeeds normally.
+	PendingPrincipalNotFound map[string]int
+}
+
+// NewProvider returns an empty Provider.
+func NewProvider() *Provider {
+	return &Provider{
+		applications:             make(map[string]*models.Application),
+		servicePrincipals:        make(map[string]*models.ServicePrincipal),
+		roleDefinitions:          make(map[string][]*armauthorization.RoleDefinition),
+		roleAssignments:          make(map[string]roleAssignment),
+		PendingPrincipalNotFound: make(map[string]int),
+	}
+}
+
+func (p *Provider) newID() string {
+	p.nextID++
+	return fmt.Sprintf("fake-id-%d", p.nextID)
+}
+
+// AddApplication seeds an application directly, bypassing CreateApplication,
+// so tests can set up duplicate-app scenarios.
+func (p *Provider) AddApplication(app *models.Application) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.applications[*app.GetId()] = app
+}
+
+// AddServicePrincipal seeds a service principal directly, bypassing
+// CreateServicePrincipal, so tests can set up duplicate-SP scenarios.
+func (p *Provider) AddServicePrincipal(sp *models.ServicePrincipal) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.servicePrincipals[*sp.GetId()] = sp
+}
+
+// AddRoleDefinition seeds a role definition findable by roleName via
+// ListRoleDefinitions.
+func (p *Provider) AddRoleDefinition(roleName, roleDefinitionID string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.roleDefinitions[roleName] = append(p.roleDefinitions[roleName], &armauthorization.RoleDefinition{
+		ID: to.StringPtr(roleDefinitionID),
+	})
+}
+
+// AddRoleAssignment seeds an existing role assignment, so tests can exercise
+// the RoleAssignmentExists path.
+func (p *Provider) AddRoleAssignment(scope, name, roleDefinitionID, principalID string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.roleAssignments[scope+"/"+name] = roleAssignment{
+		scope: scope,
+		assignment: &armauthorization.RoleAssignment{
+			Name: to.StringPtr(name),
+			Properties: &armauthorization.RoleAssignmentProperties{
+				RoleDefinitionID: to.StringPtr(roleDefinitionID),
+				PrincipalID:      to.StringPtr(principalID),
+			},
+		},
+	}
+}
+
+func (p *Provider) CreateApplication(ctx context.Context, displayName string, passwordCredential models.PasswordCredentialable) (*models.Application, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	id := p.newID()
+	appID := p.newID()
+
+	if pc, ok := passwordCredential.(*models.PasswordCredential); ok {
+		keyID := guuid.New()
+		pc.SetKeyId(&keyID)
+	}
+
+	app := models.NewApplication()
+	app.SetId(&id)
+	app.SetAppId(&appID)
+	app.SetDisplayName(&displayName)
+	app.SetPasswordCredentials([]models.PasswordCredentialable{passwordCredential})
+	app.SetTags([]string{operatorOwnedTag})
+
+	p.applications[id] = app
+	return app, nil
+}
+
+func (p *Provider) GetApplication(ctx context.Context, appObjectID string) (*models.Application, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	app, ok := p.applications[appObjectID]
+	if !ok {
+		return nil, fmt.Errorf("no application with id %q", appObjectID)
+	}
+	return app, nil
+}
+
+func (p *Provider) ListApplicationsByDisplayName(ctx context.Context, displayName string) ([]*models.Application, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var matches []*models.Application
+	for _, app := range p.applications {
+		if app.GetDisplayName() != nil && *app.GetDisplayName() == displayName {
+			matches = append(matches, app)
+		}
+	}
+	return matches, nil
+}
+
+// ListAllApplications returns only the applications tagged operatorOwnedTag,
+// the same scoping graphAzureProvider.ListAllApplications applies in
+// production, rather than every application the fake holds.
+func (p *Provider) ListAllApplications(ctx context.Context) ([]*models.Application, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var owned []*models.Application
+	for _, app := range p.applications {
+		if hasOperatorOwnedTag(app) {
+			owned = append(owned, app)
+		}
+	}
+	return owned, nil
+}
+
+func hasOperatorOwnedTag(app *models.Application) bool {
+	for _, tag := range app.GetTags() {
+		if tag == operatorOwnedTag {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Provider) DeleteApplication(ctx context.Context, appObjectID string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if _, ok := p.applications[appObjectID]; !ok {
+		return fmt.Errorf("no application with id %q", appObjectID)
+	}
+	delete(p.applications, appObjectID)
+	return nil
+}
+
+func (p *Provider) AddApplicationPassword(ctx context.Context, appObjectID, displayName string, endDateTime time.Time) (string, string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	app, ok := p.applications[appObjectID]
+	if !ok {
+		return "", "", fmt.Errorf("no application with id %q", appObjectID)
+	}
+
+	keyID := guuid.New()
+	secretText := "fake-secret-" + keyID.String()
+
+	credential := models.NewPasswordCredential()
+	credential.SetKeyId(&keyID)
+	credential.SetDisplayName(&displayName)
+	credential.SetEndDateTime(&endDateTime)
+	credential.SetSecretText(&secretText)
+
+	app.SetPasswordCredentials(append(app.GetPasswordCredentials(), credential))
+	return secretText, keyID.String(), nil
+}
+
+func (p *Provider) RemoveApplicationPassword(ctx context.Context, appObjectID, keyID string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	app, ok := p.applications[appObjectID]
+	if !ok {
+		return fmt.Errorf("no application with id %q", appObjectID)
+	}
+
+	var remaining []models.PasswordCredentialable
+	found := false
+	for _, credential := range app.GetPasswordCredentials() {
+		if credential.GetKeyId() != nil && credential.GetKeyId().String() == keyID {
+			found = true
+			continue
+		}
+		remaining = append(remaining, credential)
+	}
+	if !found {
+		return fmt.Errorf("no password credential with keyId %q", keyID)
+	}
+	app.SetPasswordCredentials(remaining)
+	return nil
+}
+
+func (p *Provider) CreateServicePrincipal(ctx context.Context, appID string) (*models.ServicePrincipal, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	id := p.newID()
+	sp := models.NewServicePrincipal()
+	sp.SetId(&id)
+	sp.SetAppId(&appID)
+
+	p.servicePrincipals[id] = sp
+	return sp, nil
+}
+
+func (p *Provider) GetServicePrincipalByAppID(ctx context.Context, appID string) ([]*models.ServicePrincipal, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var matches []*models.ServicePrincipal
+	for _, sp := range p.servicePrincipals {
+		if sp.GetAppId() != nil && *sp.GetAppId() == appID {
+			matches = append(matches, sp)
+		}
+	}
+	return matches, nil
+}
+
+func (p *Provider) GetServicePrincipal(ctx context.Context, servicePrincipalID string) (*models.ServicePrincipal, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	sp, ok := p.servicePrincipals[servicePrincipalID]
+	if !ok {
+		return nil, fmt.Errorf("no service principal with id %q", servicePrincipalID)
+	}
+	return sp, nil
+}
+
+func (p *Provider) CreateRoleAssignment(ctx context.Context, scope, name, roleDefinitionID, principalID string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if remaining, ok := p.PendingPrincipalNotFound[principalID]; ok && remaining > 0 {
+		p.PendingPrincipalNotFound[principalID] = remaining - 1
+		return &azcore.ResponseError{ErrorCode: "PrincipalNotFound", StatusCode: 400}
+	}
+
+	key := scope + "/" + name
+	if _, exists := p.roleAssignments[key]; exists {
+		// Retrying the same named assignment is idempotent.
+		return nil
+	}
+
+	for _, ra := range p.roleAssignments {
+		if ra.scope != scope {
+			continue
+		}
+		if ra.assignment.Properties == nil || ra.assignment.Properties.PrincipalID == nil {
+			continue
+		}
+		if *ra.assignment.Properties.PrincipalID == principalID {
+			return &azcore.ResponseError{ErrorCode: "RoleAssignmentExists", StatusCode: 409}
+		}
+	}
+
+	p.roleAssignments[key] = roleAssignment{
+		scope: scope,
+		assignment: &armauthorization.RoleAssignment{
+			Name: to.StringPtr(name),
+			Properties: &armauthorization.RoleAssignmentProperties{
+				RoleDefinitionID: to.StringPtr(roleDefinitionID),
+				PrincipalID:      to.StringPtr(principalID),
+			},
+		},
+	}
+	return nil
+}
+
+func (p *Provider) ListRoleAssignmentsByPrincipal(ctx context.Context, scope, principalID string) ([]*armauthorization.RoleAssignment, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var matches []*armauthorization.RoleAssignment
+	for _, ra := range p.roleAssignments {
+		if ra.scope != scope {
+			continue
+		}
+		if ra.assignment.Properties == nil || ra.assignment.Properties.PrincipalID == nil {
+			continue
+		}
+		if *ra.assignment.Properties.PrincipalID == principalID {
+			matches = append(matches, ra.assignment)
+		}
+	}
+	return matches, nil
+}
+
+func (p *Provider) ListRoleDefinitions(ctx context.Context, roleName string) ([]*armauthorization.RoleDefinition, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.roleDefinitions[roleName], nil
+}
@@ -2,6 +2,7 @@ package azure
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"strings"
 	"time"
@@ -9,6 +10,9 @@ import (
 	log "github.com/sirupsen/logrus"
 	"k8s.io/apimachinery/pkg/util/wait"
 
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/authorization/armauthorization"
 	"github.com/Azure/azure-sdk-for-go/services/authorization/mgmt/2015-07-01/authorization"
 	"github.com/Azure/azure-sdk-for-go/services/graphrbac/1.6/graphrbac"
 	"github.com/Azure/go-autorest/autorest"
@@ -16,6 +20,10 @@ import (
 	"github.com/Azure/go-autorest/autorest/azure/auth"
 	"github.com/Azure/go-autorest/autorest/date"
 	"github.com/Azure/go-autorest/autorest/to"
+	kiotaauth "github.com/microsoft/kiota-authentication-azure-go"
+	msgraphsdk "github.com/microsoftgraph/msgraph-sdk-go"
+	"github.com/microsoftgraph/msgraph-sdk-go/models"
+	"github.com/microsoftgraph/msgraph-sdk-go/models/odataerrors"
 	uuid "github.com/satori/go.uuid"
 )
 
@@ -27,52 +35,630 @@ func getAuthorizer(clientID, clientSecret, tenantID, resourceEndpoint string) (a
 
 // AzureCredentialsMinter mints new resource scoped service principals
 type AzureCredentialsMinter struct {
-	appClient             graphrbac.ApplicationsClient
-	spClient              graphrbac.ServicePrincipalsClient
-	roleAssignmentsClient authorization.RoleAssignmentsClient
-	roleDefinitionClient  authorization.RoleDefinitionsClient
-	tenantID              string
-	subscriptionID        string
-	logger                log.FieldLogger
+	// useAADGraph selects the deprecated AAD Graph (graphrbac) code path
+	// instead of Microsoft Graph. This exists only to give consumers one
+	// release to migrate and will be removed afterwards.
+	useAADGraph bool
+
+	// provider performs the actual Microsoft Graph / ARM authorization calls,
+	// used unless useAADGraph is set. Abstracted behind AzureProvider so
+	// tests can substitute azure/fake instead of talking to Azure.
+	provider AzureProvider
+
+	// Deprecated AAD Graph clients, retained for the useAADGraph fallback.
+	appClient graphrbac.ApplicationsClient
+	spClient  graphrbac.ServicePrincipalsClient
+
+	// Deprecated 2015-07-01 ARM authorization clients, retained for the
+	// useAADGraph fallback.
+	legacyRoleAssignmentsClient authorization.RoleAssignmentsClient
+	legacyRoleDefinitionClient  authorization.RoleDefinitionsClient
+
+	tenantID       string
+	subscriptionID string
+	logger         log.FieldLogger
+
+	// credentialLifetime is the default validity period applied to newly
+	// minted AAD application passwords. CreateOrUpdateAADApplication accepts
+	// a per-call override; 0 there means "use this default".
+	credentialLifetime time.Duration
+
+	// roleAssignmentBackoff is the backoff used while retrying role
+	// assignment creation in assignRoleDefinitionToResourceGroups. It
+	// defaults to roleAssignmentRetryBackoff(); tests substitute a much
+	// faster backoff so retry paths don't block on real sleeps.
+	roleAssignmentBackoff wait.Backoff
 }
 
-func newAzureCredentialsMinter(logger log.FieldLogger, clientID, clientSecret, tenantID, subscriptionID string) (*AzureCredentialsMinter, error) {
-	graphAuthorizer, err := getAuthorizer(clientID, clientSecret, tenantID, azure.PublicCloud.GraphEndpoint)
+// DefaultCredentialLifetime is how long a minted AAD application password is
+// valid for when neither the operator config nor the CredentialsRequest
+// specifies a lifetime. Previously this was hard-coded to one year, which
+// left no margin for a missed rotation before secrets expired outright.
+const DefaultCredentialLifetime = 2 * 365 * 24 * time.Hour
+
+func newAzureCredentialsMinter(logger log.FieldLogger, clientID, clientSecret, tenantID, subscriptionID string, useAADGraph bool, credentialLifetime time.Duration) (*AzureCredentialsMinter, error) {
+	if credentialLifetime <= 0 {
+		credentialLifetime = DefaultCredentialLifetime
+	}
+
+	credMinter := &AzureCredentialsMinter{
+		useAADGraph:           useAADGraph,
+		tenantID:              tenantID,
+		subscriptionID:        subscriptionID,
+		credentialLifetime:    credentialLifetime,
+		logger:                logger,
+		roleAssignmentBackoff: roleAssignmentRetryBackoff(),
+	}
+
+	if useAADGraph {
+		logger.Warning("using the deprecated AAD Graph API; this fallback will be removed in a future release")
+
+		graphAuthorizer, err := getAuthorizer(clientID, clientSecret, tenantID, azure.PublicCloud.GraphEndpoint)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to construct GraphEndpoint authorizer: %v", err)
+		}
+
+		appClient := graphrbac.NewApplicationsClient(tenantID)
+		appClient.Authorizer = graphAuthorizer
+		credMinter.appClient = appClient
+
+		spClient := graphrbac.NewServicePrincipalsClient(tenantID)
+		spClient.Authorizer = graphAuthorizer
+		credMinter.spClient = spClient
+
+		rmAuthorizer, err := getAuthorizer(clientID, clientSecret, tenantID, azure.PublicCloud.ResourceManagerEndpoint)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to construct ResourceManagerEndpoint authorizer: %v", err)
+		}
+
+		legacyRoleAssignmentsClient := authorization.NewRoleAssignmentsClient(subscriptionID)
+		legacyRoleAssignmentsClient.Authorizer = rmAuthorizer
+		credMinter.legacyRoleAssignmentsClient = legacyRoleAssignmentsClient
+
+		legacyRoleDefinitionClient := authorization.NewRoleDefinitionsClient(subscriptionID)
+		legacyRoleDefinitionClient.Authorizer = rmAuthorizer
+		credMinter.legacyRoleDefinitionClient = legacyRoleDefinitionClient
+
+		return credMinter, nil
+	}
+
+	cred, err := azidentity.NewClientSecretCredential(tenantID, clientID, clientSecret, nil)
 	if err != nil {
-		return nil, fmt.Errorf("Unable to construct GraphEndpoint authorizer: %v", err)
+		return nil, fmt.Errorf("unable to construct Azure credential: %v", err)
 	}
 
-	addapclient := graphrbac.NewApplicationsClient(tenantID)
-	addapclient.Authorizer = graphAuthorizer
+	authProvider, err := kiotaauth.NewAzureIdentityAuthenticationProviderWithScopes(cred, []string{"https://graph.microsoft.com/.default"})
+	if err != nil {
+		return nil, fmt.Errorf("unable to construct Microsoft Graph auth provider: %v", err)
+	}
 
-	spClient := graphrbac.NewServicePrincipalsClient(tenantID)
-	spClient.Authorizer = graphAuthorizer
+	adapter, err := msgraphsdk.NewGraphRequestAdapter(authProvider)
+	if err != nil {
+		return nil, fmt.Errorf("unable to construct Microsoft Graph request adapter: %v", err)
+	}
 
-	rmAuthorizer, err := getAuthorizer(clientID, clientSecret, tenantID, azure.PublicCloud.ResourceManagerEndpoint)
+	roleAssignmentsClient, err := armauthorization.NewRoleAssignmentsClient(subscriptionID, cred, nil)
 	if err != nil {
-		return nil, fmt.Errorf("Unable to construct ResourceManagerEndpoint authorizer: %v", err)
+		return nil, fmt.Errorf("unable to construct RoleAssignments client: %v", err)
 	}
 
-	roleAssignmentsClient := authorization.NewRoleAssignmentsClient(subscriptionID)
-	roleAssignmentsClient.Authorizer = rmAuthorizer
+	roleDefinitionClient, err := armauthorization.NewRoleDefinitionsClient(cred, nil)
+	if err != nil {
+		return nil, fmt.Errorf("unable to construct RoleDefinitions client: %v", err)
+	}
 
-	roleDefinitionClient := authorization.NewRoleDefinitionsClient(subscriptionID)
-	roleDefinitionClient.Authorizer = rmAuthorizer
+	credMinter.provider = &graphAzureProvider{
+		graphClient:           msgraphsdk.NewGraphServiceClient(adapter),
+		requestAdapter:        adapter,
+		roleAssignmentsClient: roleAssignmentsClient,
+		roleDefinitionClient:  roleDefinitionClient,
+		subscriptionID:        subscriptionID,
+	}
 
+	return credMinter, nil
+}
+
+// newAzureCredentialsMinterWithProvider builds a minter around an explicit
+// AzureProvider, bypassing client construction entirely. Used by tests to
+// substitute azure/fake for the production Microsoft Graph / ARM clients.
+func newAzureCredentialsMinterWithProvider(logger log.FieldLogger, tenantID, subscriptionID string, provider AzureProvider, credentialLifetime time.Duration) *AzureCredentialsMinter {
+	if credentialLifetime <= 0 {
+		credentialLifetime = DefaultCredentialLifetime
+	}
 	return &AzureCredentialsMinter{
-		appClient:             addapclient,
-		spClient:              spClient,
+		provider:              provider,
 		tenantID:              tenantID,
 		subscriptionID:        subscriptionID,
-		roleAssignmentsClient: roleAssignmentsClient,
-		roleDefinitionClient:  roleDefinitionClient,
+		credentialLifetime:    credentialLifetime,
 		logger:                logger,
-	}, nil
+		roleAssignmentBackoff: roleAssignmentRetryBackoff(),
+	}
 }
 
 // CreateOrUpdateAADApplication creates a new AAD application. If the application
-// already exist, new client secret is generated if requested.
-func (credMinter *AzureCredentialsMinter) CreateOrUpdateAADApplication(ctx context.Context, aadAppName string, regenClientSecret bool) (*graphrbac.Application, string, error) {
+// already exists, a new client secret is generated if requested. The returned
+// keyID identifies the generated password credential so the caller can later
+// remove just that credential (e.g. via RemovePasswordCredentialByKeyID) without
+// clobbering any other credential on the application. lifetime overrides how
+// long the generated password is valid for; 0 uses the minter's configured
+// credentialLifetime.
+func (credMinter *AzureCredentialsMinter) CreateOrUpdateAADApplication(ctx context.Context, aadAppName string, regenClientSecret bool, lifetime time.Duration) (app *models.Application, secret string, keyID string, err error) {
+	if lifetime <= 0 {
+		lifetime = credMinter.credentialLifetime
+	}
+
+	if credMinter.useAADGraph {
+		app, secret, err := credMinter.createOrUpdateAADApplicationLegacy(ctx, aadAppName, regenClientSecret, lifetime)
+		return app, secret, "", err
+	}
+
+	appItems, err := credMinter.provider.ListApplicationsByDisplayName(ctx, aadAppName)
+	if err != nil {
+		return nil, "", "", fmt.Errorf("unable to list AAD applications: %v", formatGraphError(err))
+	}
+
+	switch len(appItems) {
+	case 0:
+		credMinter.logger.Infof("Creating AAD application %q", aadAppName)
+		secret := uuid.NewV4().String()
+
+		passwordCredential := newPasswordCredential(secret, time.Now().Add(lifetime))
+		app, err := credMinter.provider.CreateApplication(ctx, aadAppName, passwordCredential)
+		if err != nil {
+			return nil, "", "", fmt.Errorf("unable to create AAD application: %v", formatGraphError(err))
+		}
+		// The Graph API assigns the keyId server-side; read it back off the
+		// created application rather than generating one ourselves.
+		return app, secret, firstPasswordCredentialKeyID(app), nil
+	case 1:
+		app := appItems[0]
+		credMinter.logger.Infof("Found AAD application %q", aadAppName)
+		clientSecret := ""
+		newKeyID := ""
+		if regenClientSecret {
+			oldKeyIDs := passwordCredentialKeyIDs(app)
+
+			secret, keyID, err := credMinter.AddPasswordCredential(ctx, *app.GetId(), aadAppName, time.Now().Add(lifetime))
+			if err != nil {
+				return nil, "", "", fmt.Errorf("unable to add AAD application password: %v", err)
+			}
+			clientSecret = secret
+			newKeyID = keyID
+
+			for _, oldKeyID := range oldKeyIDs {
+				if err := credMinter.RemovePasswordCredentialByKeyID(ctx, *app.GetId(), oldKeyID); err != nil {
+					return nil, "", "", fmt.Errorf("unable to remove previous AAD application password %q: %v", oldKeyID, err)
+				}
+			}
+		}
+		return app, clientSecret, newKeyID, nil
+	default:
+		return nil, "", "", fmt.Errorf("found %q AAD application with name %q, unable to proceed", len(appItems), aadAppName)
+	}
+}
+
+const (
+	// servicePrincipalReplicationPollInterval is how often we re-check
+	// whether a newly created service principal has replicated across AAD.
+	servicePrincipalReplicationPollInterval = 5 * time.Second
+	// servicePrincipalReplicationTimeout bounds how long we wait for AAD
+	// directory replication; in practice this can take up to ~15 minutes.
+	servicePrincipalReplicationTimeout = 15 * time.Minute
+)
+
+// waitForServicePrincipalReplication blocks until servicePrincipalID can be
+// retrieved by ID, which signals that it has replicated across AAD directory
+// replicas. Creating a role assignment (or looking the SP up again) too soon
+// after creation routinely fails with PrincipalNotFound even though the SP
+// was successfully created.
+func (credMinter *AzureCredentialsMinter) waitForServicePrincipalReplication(ctx context.Context, servicePrincipalID string) error {
+	if credMinter.useAADGraph {
+		return wait.PollImmediate(servicePrincipalReplicationPollInterval, servicePrincipalReplicationTimeout, func() (bool, error) {
+			_, err := credMinter.spClient.Get(ctx, servicePrincipalID)
+			return err == nil, nil
+		})
+	}
+	return wait.PollImmediate(servicePrincipalReplicationPollInterval, servicePrincipalReplicationTimeout, func() (bool, error) {
+		_, err := credMinter.provider.GetServicePrincipal(ctx, servicePrincipalID)
+		return err == nil, nil
+	})
+}
+
+// CreateOrGetServicePrincipal creates a new SP and returns it.
+// Service principal that already exist is returned.
+func (credMinter *AzureCredentialsMinter) CreateOrGetServicePrincipal(ctx context.Context, appID string) (*models.ServicePrincipal, error) {
+	if credMinter.useAADGraph {
+		return credMinter.createOrGetServicePrincipalLegacy(ctx, appID)
+	}
+
+	spItems, err := credMinter.provider.GetServicePrincipalByAppID(ctx, appID)
+	if err != nil {
+		return nil, formatGraphError(err)
+	}
+
+	switch len(spItems) {
+	case 0:
+		credMinter.logger.Infof("Creating service principal for AAD application %q", appID)
+		var servicePrincipal *models.ServicePrincipal
+		err := wait.PollImmediate(5*time.Second, 60*time.Second, func() (bool, error) {
+			sp, err := credMinter.provider.CreateServicePrincipal(ctx, appID)
+			if isODataError(err, "NoBackingApplicationObject") {
+				return false, nil
+			}
+			servicePrincipal = sp
+			return err == nil, nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("unable to create service principal: %v", formatGraphError(err))
+		}
+		if servicePrincipal.GetId() != nil {
+			if err := credMinter.waitForServicePrincipalReplication(ctx, *servicePrincipal.GetId()); err != nil {
+				return nil, fmt.Errorf("service principal for AAD application %q did not replicate in time: %v", appID, err)
+			}
+		}
+		return servicePrincipal, nil
+	case 1:
+		sp := spItems[0]
+		if sp.GetDisplayName() != nil {
+			credMinter.logger.Infof("Found service principal %q", *sp.GetDisplayName())
+		}
+		return sp, nil
+	default:
+		return nil, fmt.Errorf("found more than 1 service principals with %q appID, will do nothing", appID)
+	}
+}
+
+// AssignResourceScopedRole assigns a resource scoped role to a service principal
+func (credMinter *AzureCredentialsMinter) AssignResourceScopedRole(ctx context.Context, resourceGroups []string, principalID, principalName, targetRole string) error {
+	if credMinter.useAADGraph {
+		return credMinter.assignResourceScopedRoleLegacy(ctx, resourceGroups, principalID, principalName, targetRole)
+	}
+
+	roleDefinitions, err := credMinter.provider.ListRoleDefinitions(ctx, targetRole)
+	if err != nil {
+		return fmt.Errorf("unable to list role definitions: %v", formatGraphError(err))
+	}
+
+	var roleDefinition *armauthorization.RoleDefinition
+	switch len(roleDefinitions) {
+	case 0:
+		return fmt.Errorf("find no role %q", targetRole)
+	case 1:
+		roleDefinition = roleDefinitions[0]
+		if roleDefinition.ID != nil {
+			credMinter.logger.Infof("Found role %q under %q", targetRole, *roleDefinition.ID)
+		}
+	default:
+		return fmt.Errorf("more than one role %q found", targetRole)
+	}
+
+	// Resolve to the role definition ID once, then hand off to the same
+	// assignment path AssignResourceScopedRoleByID uses, rather than
+	// duplicating the retry/backoff logic here.
+	return credMinter.assignRoleDefinitionToResourceGroups(ctx, resourceGroups, principalID, principalName, targetRole, roleDefinition.ID)
+}
+
+// AssignResourceScopedRoleByID assigns a resource scoped role to a service
+// principal by built-in or custom role definition GUID (see BuiltInRoles for
+// the commonly-used built-in GUIDs), avoiding the locale-sensitive and
+// ambiguous roleName display-name lookup AssignResourceScopedRole performs.
+func (credMinter *AzureCredentialsMinter) AssignResourceScopedRoleByID(ctx context.Context, resourceGroups []string, principalID, principalName, roleDefinitionID string) error {
+	if credMinter.useAADGraph {
+		return credMinter.assignResourceScopedRoleByIDLegacy(ctx, resourceGroups, principalID, principalName, roleDefinitionID)
+	}
+
+	fullRoleDefinitionID := fmt.Sprintf("/subscriptions/%s/providers/Microsoft.Authorization/roleDefinitions/%s", credMinter.subscriptionID, roleDefinitionID)
+	return credMinter.assignRoleDefinitionToResourceGroups(ctx, resourceGroups, principalID, principalName, roleDefinitionID, &fullRoleDefinitionID)
+}
+
+// assignRoleDefinitionToResourceGroups creates the role assignment for an
+// already-resolved roleDefinitionID in each of resourceGroups, retrying
+// through transient failures. roleLabel is used only for logging/error
+// messages.
+func (credMinter *AzureCredentialsMinter) assignRoleDefinitionToResourceGroups(ctx context.Context, resourceGroups []string, principalID, principalName, roleLabel string, roleDefinitionID *string) error {
+	for _, resourceGroup := range resourceGroups {
+		scope := "subscriptions/" + credMinter.subscriptionID + "/resourceGroups/" + resourceGroup
+		raName := uuid.NewV4().String()
+
+		condition := func() (bool, error) {
+			err := credMinter.provider.CreateRoleAssignment(ctx, scope, raName, *roleDefinitionID, principalID)
+
+			var respErr *azcore.ResponseError
+			if errors.As(err, &respErr) {
+				switch respErr.ErrorCode {
+				case "PrincipalNotFound", "RoleDefinitionDoesNotExist":
+					return false, nil
+				case "RoleAssignmentExists":
+					// A previous attempt (or another controller) may already
+					// have created this assignment; only treat it as success
+					// once we've confirmed it's the assignment we wanted,
+					// not some stale, mismatched one.
+					matches, matchErr := credMinter.roleAssignmentMatches(ctx, scope, principalID, roleDefinitionID)
+					if matchErr != nil {
+						return false, matchErr
+					}
+					if !matches {
+						return false, fmt.Errorf("existing role assignment at %q for principal %q does not match requested role %q", scope, principalID, roleLabel)
+					}
+					return true, nil
+				}
+				if isTransientStatusCode(respErr.StatusCode) {
+					return false, nil
+				}
+			}
+
+			return err == nil, err
+		}
+
+		// Not wait.ExponentialBackoff: wait.Backoff stops retrying as soon as
+		// the delay reaches Cap, whereas this keeps retrying at Cap.
+		backoff := credMinter.roleAssignmentBackoff
+		done, err := condition()
+		for ; !done && err == nil && backoff.Steps > 1; done, err = condition() {
+			backoff.Steps--
+			time.Sleep(backoff.Duration)
+			if backoff.Duration = time.Duration(float64(backoff.Duration) * backoff.Factor); backoff.Cap > 0 && backoff.Duration > backoff.Cap {
+				backoff.Duration = backoff.Cap
+			}
+		}
+		if err == nil && !done {
+			err = wait.ErrWaitTimeout
+		}
+
+		if err != nil {
+			return fmt.Errorf("unable to assign role to principal %q (%v): %v", principalName, principalID, err)
+		}
+
+		credMinter.logger.Infof("Assigned %q role scoped to %q to principal %q (%v)", roleLabel, resourceGroup, principalName, principalID)
+	}
+	return nil
+}
+
+// roleAssignmentRetryBackoff returns the default bounded exponential backoff
+// used while retrying role assignment creation: an initial 5s delay doubling
+// up to a 60s cap, then every 60s. Its 19 attempts wait about 15 minutes in
+// all, roughly the same window we allow for AAD directory replication. Both
+// minter constructors set this as the initial value of roleAssignmentBackoff;
+// tests substitute a faster one.
+func roleAssignmentRetryBackoff() wait.Backoff {
+	return wait.Backoff{
+		Duration: 5 * time.Second,
+		Factor:   2,
+		Cap:      60 * time.Second,
+		Steps:    19,
+	}
+}
+
+// isTransientStatusCode reports whether an HTTP status code represents a
+// transient failure (rate limiting or a server error) worth retrying.
+func isTransientStatusCode(statusCode int) bool {
+	return statusCode == 429 || statusCode >= 500
+}
+
+// roleAssignmentMatches reports whether a role assignment for principalID at
+// scope already exists with the given roleDefinitionID, by listing existing
+// assignments rather than trusting a bare RoleAssignmentExists error.
+func (credMinter *AzureCredentialsMinter) roleAssignmentMatches(ctx context.Context, scope, principalID string, roleDefinitionID *string) (bool, error) {
+	if roleDefinitionID == nil {
+		return false, nil
+	}
+
+	roleAssignments, err := credMinter.provider.ListRoleAssignmentsByPrincipal(ctx, scope, principalID)
+	if err != nil {
+		return false, fmt.Errorf("unable to list role assignments at %q: %v", scope, formatGraphError(err))
+	}
+	for _, ra := range roleAssignments {
+		if ra.Properties == nil || ra.Properties.RoleDefinitionID == nil || ra.Properties.PrincipalID == nil {
+			continue
+		}
+		if *ra.Properties.RoleDefinitionID == *roleDefinitionID && *ra.Properties.PrincipalID == principalID {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// DeleteAADApplication deletes an AAD application.
+// If the application does not exist, it's no-op.
+func (credMinter *AzureCredentialsMinter) DeleteAADApplication(ctx context.Context, aadAppName string) error {
+	if credMinter.useAADGraph {
+		return credMinter.deleteAADApplicationLegacy(ctx, aadAppName)
+	}
+
+	appItems, err := credMinter.provider.ListApplicationsByDisplayName(ctx, aadAppName)
+	if err != nil {
+		return fmt.Errorf("unable to list AAD applications: %v", formatGraphError(err))
+	}
+
+	switch len(appItems) {
+	case 0:
+		credMinter.logger.Infof("No AAD application %q found, doing nothing", aadAppName)
+		return nil
+	case 1:
+		app := appItems[0]
+		credMinter.logger.Infof("Deleting AAD application %q", aadAppName)
+		if err := credMinter.provider.DeleteApplication(ctx, *app.GetId()); err != nil {
+			if app.GetDisplayName() != nil {
+				return fmt.Errorf("unable to delete AAD application %v (%v): %v", *app.GetDisplayName(), *app.GetId(), formatGraphError(err))
+			}
+			return fmt.Errorf("unable to delete AAD application %v: %v", *app.GetId(), formatGraphError(err))
+		}
+		return nil
+	default:
+		return fmt.Errorf("found more than 1 AAD application with %q name, will do nothing", aadAppName)
+	}
+}
+
+// RotatedCredential describes a password credential that RotateExpiringCredentials
+// replaced, so the caller can update the corresponding Kubernetes secret.
+type RotatedCredential struct {
+	ApplicationID          string
+	ApplicationDisplayName string
+	SecretText             string
+	KeyID                  string
+}
+
+// RotateExpiringCredentials lists every AAD application owned by the operator,
+// and for any whose password credentials expire within threshold, adds a
+// fresh password and removes the expiring one(s), atomically, via
+// AddPasswordCredential/RemovePasswordCredentialByKeyID. The expiring
+// credentials are already removed when this returns, so the returned secrets
+// are the only valid ones; the caller is responsible for writing them to the
+// matching Kubernetes Secret. Nothing in this package calls it.
+func (credMinter *AzureCredentialsMinter) RotateExpiringCredentials(ctx context.Context, threshold time.Duration) ([]RotatedCredential, error) {
+	if credMinter.useAADGraph {
+		return nil, errors.New("RotateExpiringCredentials requires Microsoft Graph and is unavailable in the useAADGraph fallback")
+	}
+
+	apps, err := credMinter.provider.ListAllApplications(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list AAD applications: %v", formatGraphError(err))
+	}
+
+	var rotated []RotatedCredential
+	for _, app := range apps {
+		if app.GetId() == nil {
+			continue
+		}
+		displayName := derefOrEmpty(app.GetDisplayName())
+
+		var expiringKeyIDs []string
+		for _, credential := range app.GetPasswordCredentials() {
+			if credential.GetEndDateTime() == nil || credential.GetKeyId() == nil {
+				continue
+			}
+			if time.Until(*credential.GetEndDateTime()) > threshold {
+				continue
+			}
+			expiringKeyIDs = append(expiringKeyIDs, credential.GetKeyId().String())
+		}
+		if len(expiringKeyIDs) == 0 {
+			continue
+		}
+
+		credMinter.logger.Infof("Rotating %d expiring password credential(s) on AAD application %q", len(expiringKeyIDs), displayName)
+		secret, keyID, err := credMinter.AddPasswordCredential(ctx, *app.GetId(), displayName, time.Now().Add(credMinter.credentialLifetime))
+		if err != nil {
+			return rotated, fmt.Errorf("unable to rotate credential for AAD application %q: %v", displayName, err)
+		}
+
+		for _, oldKeyID := range expiringKeyIDs {
+			if err := credMinter.RemovePasswordCredentialByKeyID(ctx, *app.GetId(), oldKeyID); err != nil {
+				return rotated, fmt.Errorf("unable to remove expiring credential %q on AAD application %q: %v", oldKeyID, displayName, err)
+			}
+		}
+
+		rotated = append(rotated, RotatedCredential{
+			ApplicationID:          *app.GetId(),
+			ApplicationDisplayName: displayName,
+			SecretText:             secret,
+			KeyID:                  keyID,
+		})
+	}
+
+	return rotated, nil
+}
+
+// newPasswordCredential builds a Microsoft Graph password credential for the
+// given secret value and expiry.
+func newPasswordCredential(secret string, endDateTime time.Time) models.PasswordCredentialable {
+	credential := models.NewPasswordCredential()
+	credential.SetSecretText(to.StringPtr(secret))
+	credential.SetEndDateTime(&endDateTime)
+	return credential
+}
+
+// AddPasswordCredential adds a single password credential to the AAD
+// application identified by appObjectID via Microsoft Graph's atomic
+// addPassword application action, and returns the server-generated keyId and
+// secretText. Unlike UpdatePasswordCredentials, this does not touch any other
+// credential already on the application.
+func (credMinter *AzureCredentialsMinter) AddPasswordCredential(ctx context.Context, appObjectID, displayName string, endDate time.Time) (secretText string, keyID string, err error) {
+	if credMinter.useAADGraph {
+		return "", "", errors.New("AddPasswordCredential requires Microsoft Graph and is unavailable in the useAADGraph fallback")
+	}
+
+	secretText, keyID, err = credMinter.provider.AddApplicationPassword(ctx, appObjectID, displayName, endDate)
+	if err != nil {
+		return "", "", fmt.Errorf("unable to add password credential: %v", formatGraphError(err))
+	}
+	return secretText, keyID, nil
+}
+
+// RemovePasswordCredentialByKeyID removes a single password credential from
+// the AAD application identified by appObjectID via Microsoft Graph's atomic
+// removePassword application action, leaving any other credential intact.
+func (credMinter *AzureCredentialsMinter) RemovePasswordCredentialByKeyID(ctx context.Context, appObjectID, keyID string) error {
+	if credMinter.useAADGraph {
+		return errors.New("RemovePasswordCredentialByKeyID requires Microsoft Graph and is unavailable in the useAADGraph fallback")
+	}
+
+	if err := credMinter.provider.RemoveApplicationPassword(ctx, appObjectID, keyID); err != nil {
+		return fmt.Errorf("unable to remove password credential %q: %v", keyID, formatGraphError(err))
+	}
+	return nil
+}
+
+// firstPasswordCredentialKeyID returns the keyId of app's first password
+// credential, or "" if it has none.
+func firstPasswordCredentialKeyID(app *models.Application) string {
+	keyIDs := passwordCredentialKeyIDs(app)
+	if len(keyIDs) == 0 {
+		return ""
+	}
+	return keyIDs[0]
+}
+
+// passwordCredentialKeyIDs returns the keyIds of all password credentials
+// currently on app.
+func passwordCredentialKeyIDs(app *models.Application) []string {
+	var keyIDs []string
+	for _, credential := range app.GetPasswordCredentials() {
+		if credential.GetKeyId() != nil {
+			keyIDs = append(keyIDs, credential.GetKeyId().String())
+		}
+	}
+	return keyIDs
+}
+
+// formatGraphError unwraps a Microsoft Graph OData error into a readable
+// message, falling back to err.Error() for anything else (e.g. transport
+// failures).
+func formatGraphError(err error) error {
+	var oDataError *odataerrors.ODataError
+	if errors.As(err, &oDataError) {
+		if mainErr := oDataError.GetErrorEscaped(); mainErr != nil && mainErr.GetMessage() != nil {
+			return fmt.Errorf("%s: %s", derefOrEmpty(mainErr.GetCode()), *mainErr.GetMessage())
+		}
+	}
+	return err
+}
+
+// isODataError reports whether err is a Microsoft Graph OData error with the
+// given error code.
+func isODataError(err error, code string) bool {
+	var oDataError *odataerrors.ODataError
+	if errors.As(err, &oDataError) {
+		if mainErr := oDataError.GetErrorEscaped(); mainErr != nil {
+			return derefOrEmpty(mainErr.GetCode()) == code
+		}
+	}
+	return false
+}
+
+func derefOrEmpty(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
+// --- deprecated AAD Graph (graphrbac) implementations, used only when
+// useAADGraph is set. These still call graphrbac and the 2015-07-01
+// authorization API directly, and will be removed once the useAADGraph
+// fallback is dropped.
+
+func (credMinter *AzureCredentialsMinter) createOrUpdateAADApplicationLegacy(ctx context.Context, aadAppName string, regenClientSecret bool, lifetime time.Duration) (*models.Application, string, error) {
 	appResp, err := credMinter.appClient.List(ctx, fmt.Sprintf("displayName eq '%v'", aadAppName))
 	if err != nil {
 		return nil, "", fmt.Errorf("unable to list AAD applications: %v", err)
@@ -88,17 +674,15 @@ func (credMinter *AzureCredentialsMinter) CreateOrUpdateAADApplication(ctx conte
 			AvailableToOtherTenants: to.BoolPtr(false),
 			PasswordCredentials: &[]graphrbac.PasswordCredential{
 				{
-					Value: &secret,
-					// INFO(jchaloup): Is one year enough?
-					// Should we also prolong the end date or generate new password in case it's outdated?
-					EndDate: &date.Time{Time: time.Now().AddDate(1, 0, 0)},
+					Value:   &secret,
+					EndDate: &date.Time{Time: time.Now().Add(lifetime)},
 				},
 			},
 		})
 		if err != nil {
 			return nil, "", fmt.Errorf("unable to create AAD application: %v", err)
 		}
-		return &app, secret, nil
+		return legacyApplicationToModel(&app), secret, nil
 	case 1:
 		credMinter.logger.Infof("Found AAD application %q", aadAppName)
 		clientSecret := ""
@@ -108,7 +692,7 @@ func (credMinter *AzureCredentialsMinter) CreateOrUpdateAADApplication(ctx conte
 				Value: &[]graphrbac.PasswordCredential{
 					{
 						Value:   &secret,
-						EndDate: &date.Time{Time: time.Now().AddDate(1, 0, 0)},
+						EndDate: &date.Time{Time: time.Now().Add(lifetime)},
 					},
 				},
 			})
@@ -117,15 +701,13 @@ func (credMinter *AzureCredentialsMinter) CreateOrUpdateAADApplication(ctx conte
 			}
 			clientSecret = secret
 		}
-		return &appItems[0], clientSecret, nil
+		return legacyApplicationToModel(&appItems[0]), clientSecret, nil
 	default:
 		return nil, "", fmt.Errorf("found %q AAD application with name %q, unable to proceed", len(appItems), aadAppName)
 	}
 }
 
-// CreateOrGetServicePrincipal creates a new SP and returns it.
-// Service principal that already exist is returned.
-func (credMinter *AzureCredentialsMinter) CreateOrGetServicePrincipal(ctx context.Context, appID string) (*graphrbac.ServicePrincipal, error) {
+func (credMinter *AzureCredentialsMinter) createOrGetServicePrincipalLegacy(ctx context.Context, appID string) (*models.ServicePrincipal, error) {
 	spResp, err := credMinter.spClient.List(ctx, fmt.Sprintf("appId eq '%v'", appID))
 	if err != nil {
 		return nil, err
@@ -152,20 +734,24 @@ func (credMinter *AzureCredentialsMinter) CreateOrGetServicePrincipal(ctx contex
 		if err != nil {
 			return nil, fmt.Errorf("unable to create service principal: %v", err)
 		}
-		return servicePrincipal, nil
+		if servicePrincipal.ObjectID != nil {
+			if err := credMinter.waitForServicePrincipalReplication(ctx, *servicePrincipal.ObjectID); err != nil {
+				return nil, fmt.Errorf("service principal for AAD application %q did not replicate in time: %v", appID, err)
+			}
+		}
+		return legacyServicePrincipalToModel(servicePrincipal), nil
 	case 1:
 		if spItems[0].DisplayName != nil {
 			credMinter.logger.Infof("Found service principal %q", *spItems[0].DisplayName)
 		}
-		return &spItems[0], nil
+		return legacyServicePrincipalToModel(&spItems[0]), nil
 	default:
 		return nil, fmt.Errorf("found more than 1 service principals with %q appID, will do nothing", appID)
 	}
 }
 
-// AssignResourceScopedRole assigns a resource scoped role to a service principal
-func (credMinter *AzureCredentialsMinter) AssignResourceScopedRole(ctx context.Context, resourceGroups []string, principalID, principalName, targetRole string) error {
-	roleDefResp, err := credMinter.roleDefinitionClient.List(ctx, "/", fmt.Sprintf("roleName eq '%v'", targetRole))
+func (credMinter *AzureCredentialsMinter) assignResourceScopedRoleLegacy(ctx context.Context, resourceGroups []string, principalID, principalName, targetRole string) error {
+	roleDefResp, err := credMinter.legacyRoleDefinitionClient.List(ctx, "/", fmt.Sprintf("roleName eq '%v'", targetRole))
 	if err != nil {
 		return err
 	}
@@ -184,14 +770,25 @@ func (credMinter *AzureCredentialsMinter) AssignResourceScopedRole(ctx context.C
 		return fmt.Errorf("more than one role %q found", targetRole)
 	}
 
+	return credMinter.assignRoleDefinitionToResourceGroupsLegacy(ctx, resourceGroups, principalID, principalName, targetRole, roleDefinition.ID)
+}
+
+// assignResourceScopedRoleByIDLegacy is the useAADGraph-fallback counterpart
+// of AssignResourceScopedRoleByID.
+func (credMinter *AzureCredentialsMinter) assignResourceScopedRoleByIDLegacy(ctx context.Context, resourceGroups []string, principalID, principalName, roleDefinitionID string) error {
+	fullRoleDefinitionID := fmt.Sprintf("/subscriptions/%s/providers/Microsoft.Authorization/roleDefinitions/%s", credMinter.subscriptionID, roleDefinitionID)
+	return credMinter.assignRoleDefinitionToResourceGroupsLegacy(ctx, resourceGroups, principalID, principalName, roleDefinitionID, &fullRoleDefinitionID)
+}
+
+func (credMinter *AzureCredentialsMinter) assignRoleDefinitionToResourceGroupsLegacy(ctx context.Context, resourceGroups []string, principalID, principalName, roleLabel string, roleDefinitionID *string) error {
 	for _, resourceGroup := range resourceGroups {
 		scope := "subscriptions/" + credMinter.subscriptionID + "/resourceGroups/" + resourceGroup
 		raName := uuid.NewV4().String()
 
-		err = wait.PollImmediate(5*time.Second, 60*time.Second, func() (bool, error) {
-			_, err = credMinter.roleAssignmentsClient.Create(ctx, scope, raName, authorization.RoleAssignmentCreateParameters{
+		err := wait.PollImmediate(5*time.Second, 60*time.Second, func() (bool, error) {
+			_, err := credMinter.legacyRoleAssignmentsClient.Create(ctx, scope, raName, authorization.RoleAssignmentCreateParameters{
 				Properties: &authorization.RoleAssignmentProperties{
-					RoleDefinitionID: roleDefinition.ID,
+					RoleDefinitionID: roleDefinitionID,
 					PrincipalID:      &principalID,
 				},
 			})
@@ -214,14 +811,12 @@ func (credMinter *AzureCredentialsMinter) AssignResourceScopedRole(ctx context.C
 			return fmt.Errorf("unable to assign role to principal %q (%v): %v", principalName, principalID, err)
 		}
 
-		credMinter.logger.Infof("Assigned %q role scoped to %q to principal %q (%v)", targetRole, resourceGroup, principalName, principalID)
+		credMinter.logger.Infof("Assigned %q role scoped to %q to principal %q (%v)", roleLabel, resourceGroup, principalName, principalID)
 	}
 	return nil
 }
 
-// DeleteAADApplication deletes an AAD application.
-// If the application does not exist, it's no-op.
-func (credMinter *AzureCredentialsMinter) DeleteAADApplication(ctx context.Context, aadAppName string) error {
+func (credMinter *AzureCredentialsMinter) deleteAADApplicationLegacy(ctx context.Context, aadAppName string) error {
 	appResp, err := credMinter.appClient.List(ctx, fmt.Sprintf("displayName eq '%v'", aadAppName))
 	if err != nil {
 		return fmt.Errorf("unable to list AAD applications: %v", err)
@@ -245,3 +840,35 @@ func (credMinter *AzureCredentialsMinter) DeleteAADApplication(ctx context.Conte
 		return fmt.Errorf("found more than 1 AAD application with %q name, will do nothing", aadAppName)
 	}
 }
+
+// legacyApplicationToModel adapts a graphrbac.Application into the
+// models.Application shape so callers don't need to branch on useAADGraph.
+func legacyApplicationToModel(app *graphrbac.Application) *models.Application {
+	m := models.NewApplication()
+	if app.ObjectID != nil {
+		m.SetId(app.ObjectID)
+	}
+	if app.DisplayName != nil {
+		m.SetDisplayName(app.DisplayName)
+	}
+	if app.AppID != nil {
+		m.SetAppId(app.AppID)
+	}
+	return m
+}
+
+// legacyServicePrincipalToModel adapts a graphrbac.ServicePrincipal into the
+// models.ServicePrincipal shape so callers don't need to branch on useAADGraph.
+func legacyServicePrincipalToModel(sp *graphrbac.ServicePrincipal) *models.ServicePrincipal {
+	m := models.NewServicePrincipal()
+	if sp.ObjectID != nil {
+		m.SetId(sp.ObjectID)
+	}
+	if sp.DisplayName != nil {
+		m.SetDisplayName(sp.DisplayName)
+	}
+	if sp.AppID != nil {
+		m.SetAppId(sp.AppID)
+	}
+	return m
+}
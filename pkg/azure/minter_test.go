@@ -0,0 +1,361 @@
+package azure
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	guuid "github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/util/wait"
+
+	"github.com/microsoftgraph/msgraph-sdk-go/models"
+	"github.com/openshift/cloud-credential-operator/pkg/azure/fake"
+)
+
+const (
+	testTenantID       = "test-tenant-id"
+	testSubscriptionID = "test-subscription-id"
+)
+
+// testRoleAssignmentBackoff replaces the production 5s-initial-delay backoff
+// with a near-instant one, so tests that drive retries (e.g. PrincipalNotFound
+// clearing after one attempt) don't block on real sleeps.
+func testRoleAssignmentBackoff() wait.Backoff {
+	return wait.Backoff{
+		Duration: time.Millisecond,
+		Factor:   1,
+		Steps:    30,
+	}
+}
+
+func newTestMinter(provider AzureProvider) *AzureCredentialsMinter {
+	logger := log.New()
+	logger.SetOutput(io.Discard)
+	credMinter := newAzureCredentialsMinterWithProvider(logger, testTenantID, testSubscriptionID, provider, 0)
+	credMinter.roleAssignmentBackoff = testRoleAssignmentBackoff()
+	return credMinter
+}
+
+func TestCreateOrUpdateAADApplicationDuplicate(t *testing.T) {
+	provider := fake.NewProvider()
+	app1 := models.NewApplication()
+	app1.SetId(strPtr("app-1"))
+	app1.SetDisplayName(strPtr("duplicate-app"))
+	app2 := models.NewApplication()
+	app2.SetId(strPtr("app-2"))
+	app2.SetDisplayName(strPtr("duplicate-app"))
+	provider.AddApplication(app1)
+	provider.AddApplication(app2)
+
+	credMinter := newTestMinter(provider)
+	_, _, _, err := credMinter.CreateOrUpdateAADApplication(context.Background(), "duplicate-app", false, 0)
+	if err == nil {
+		t.Fatal("expected an error for a duplicate AAD application, got none")
+	}
+}
+
+func TestCreateOrGetServicePrincipalDuplicate(t *testing.T) {
+	provider := fake.NewProvider()
+	sp1 := models.NewServicePrincipal()
+	sp1.SetId(strPtr("sp-1"))
+	sp1.SetAppId(strPtr("duplicate-appid"))
+	sp2 := models.NewServicePrincipal()
+	sp2.SetId(strPtr("sp-2"))
+	sp2.SetAppId(strPtr("duplicate-appid"))
+	provider.AddServicePrincipal(sp1)
+	provider.AddServicePrincipal(sp2)
+
+	credMinter := newTestMinter(provider)
+	_, err := credMinter.CreateOrGetServicePrincipal(context.Background(), "duplicate-appid")
+	if err == nil {
+		t.Fatal("expected an error for a duplicate service principal, got none")
+	}
+}
+
+func TestAssignResourceScopedRoleByIDRetriesOnPrincipalNotFound(t *testing.T) {
+	provider := fake.NewProvider()
+	provider.PendingPrincipalNotFound["principal-1"] = 1
+
+	credMinter := newTestMinter(provider)
+	err := credMinter.AssignResourceScopedRoleByID(context.Background(), []string{"rg-1"}, "principal-1", "principal-name", "role-def-1")
+	if err != nil {
+		t.Fatalf("expected AssignResourceScopedRoleByID to succeed once PrincipalNotFound clears, got: %v", err)
+	}
+}
+
+func TestAssignResourceScopedRoleByIDMatchesExistingAssignment(t *testing.T) {
+	provider := fake.NewProvider()
+	scope := "subscriptions/" + testSubscriptionID + "/resourceGroups/rg-1"
+	fullRoleDefinitionID := "/subscriptions/" + testSubscriptionID + "/providers/Microsoft.Authorization/roleDefinitions/role-def-1"
+	provider.AddRoleAssignment(scope, "existing-assignment", fullRoleDefinitionID, "principal-1")
+
+	credMinter := newTestMinter(provider)
+	err := credMinter.AssignResourceScopedRoleByID(context.Background(), []string{"rg-1"}, "principal-1", "principal-name", "role-def-1")
+	if err != nil {
+		t.Fatalf("expected a matching existing role assignment to be treated as success, got: %v", err)
+	}
+}
+
+func TestAssignResourceScopedRoleByIDMismatchedAssignmentFails(t *testing.T) {
+	provider := fake.NewProvider()
+	scope := "subscriptions/" + testSubscriptionID + "/resourceGroups/rg-1"
+	provider.AddRoleAssignment(scope, "existing-assignment", "/subscriptions/"+testSubscriptionID+"/providers/Microsoft.Authorization/roleDefinitions/some-other-role", "principal-1")
+
+	credMinter := newTestMinter(provider)
+	err := credMinter.AssignResourceScopedRoleByID(context.Background(), []string{"rg-1"}, "principal-1", "principal-name", "role-def-1")
+	if err == nil {
+		t.Fatal("expected a mismatched existing role assignment to fail, got none")
+	}
+}
+
+func TestCreateOrUpdateAADApplicationCreate(t *testing.T) {
+	provider := fake.NewProvider()
+	credMinter := newTestMinter(provider)
+
+	app, secret, keyID, err := credMinter.CreateOrUpdateAADApplication(context.Background(), "new-app", false, 0)
+	if err != nil {
+		t.Fatalf("expected CreateOrUpdateAADApplication to succeed, got: %v", err)
+	}
+	if secret == "" {
+		t.Fatal("expected a non-empty secret for a newly created application")
+	}
+	if keyID == "" {
+		t.Fatal("expected a non-empty keyID for a newly created application")
+	}
+	if app.GetDisplayName() == nil || *app.GetDisplayName() != "new-app" {
+		t.Fatalf("expected the created application to be named %q, got %v", "new-app", app.GetDisplayName())
+	}
+}
+
+func TestCreateOrUpdateAADApplicationCustomLifetime(t *testing.T) {
+	provider := fake.NewProvider()
+	credMinter := newTestMinter(provider)
+
+	lifetime := 30 * 24 * time.Hour
+	before := time.Now()
+	app, _, _, err := credMinter.CreateOrUpdateAADApplication(context.Background(), "lifetime-app", false, lifetime)
+	if err != nil {
+		t.Fatalf("expected CreateOrUpdateAADApplication to succeed, got: %v", err)
+	}
+
+	creds := app.GetPasswordCredentials()
+	if len(creds) != 1 {
+		t.Fatalf("expected 1 password credential, got %d", len(creds))
+	}
+	endDateTime := creds[0].GetEndDateTime()
+	if endDateTime == nil {
+		t.Fatal("expected the password credential to have an EndDateTime")
+	}
+	wantEnd := before.Add(lifetime)
+	if diff := endDateTime.Sub(wantEnd); diff < -time.Minute || diff > time.Minute {
+		t.Fatalf("expected EndDateTime around %v (lifetime %v), got %v", wantEnd, lifetime, *endDateTime)
+	}
+}
+
+func TestCreateOrUpdateAADApplicationDefaultLifetime(t *testing.T) {
+	provider := fake.NewProvider()
+	credMinter := newTestMinter(provider)
+
+	before := time.Now()
+	app, _, _, err := credMinter.CreateOrUpdateAADApplication(context.Background(), "default-lifetime-app", false, 0)
+	if err != nil {
+		t.Fatalf("expected CreateOrUpdateAADApplication to succeed, got: %v", err)
+	}
+
+	creds := app.GetPasswordCredentials()
+	if len(creds) != 1 {
+		t.Fatalf("expected 1 password credential, got %d", len(creds))
+	}
+	endDateTime := creds[0].GetEndDateTime()
+	if endDateTime == nil {
+		t.Fatal("expected the password credential to have an EndDateTime")
+	}
+	wantEnd := before.Add(DefaultCredentialLifetime)
+	if diff := endDateTime.Sub(wantEnd); diff < -time.Minute || diff > time.Minute {
+		t.Fatalf("expected EndDateTime around the default lifetime %v, got %v", DefaultCredentialLifetime, *endDateTime)
+	}
+}
+
+func TestCreateOrGetServicePrincipalCreate(t *testing.T) {
+	provider := fake.NewProvider()
+	credMinter := newTestMinter(provider)
+
+	sp, err := credMinter.CreateOrGetServicePrincipal(context.Background(), "new-appid")
+	if err != nil {
+		t.Fatalf("expected CreateOrGetServicePrincipal to succeed, got: %v", err)
+	}
+	if sp.GetAppId() == nil || *sp.GetAppId() != "new-appid" {
+		t.Fatalf("expected the service principal to be backed by appID %q, got %v", "new-appid", sp.GetAppId())
+	}
+}
+
+func TestAssignResourceScopedRole(t *testing.T) {
+	provider := fake.NewProvider()
+	provider.AddRoleDefinition("Contributor", "role-def-1")
+
+	credMinter := newTestMinter(provider)
+	err := credMinter.AssignResourceScopedRole(context.Background(), []string{"rg-1"}, "principal-1", "principal-name", "Contributor")
+	if err != nil {
+		t.Fatalf("expected AssignResourceScopedRole to succeed, got: %v", err)
+	}
+}
+
+func TestDeleteAADApplication(t *testing.T) {
+	provider := fake.NewProvider()
+	app := models.NewApplication()
+	app.SetId(strPtr("app-1"))
+	app.SetDisplayName(strPtr("delete-me"))
+	provider.AddApplication(app)
+
+	credMinter := newTestMinter(provider)
+	if err := credMinter.DeleteAADApplication(context.Background(), "delete-me"); err != nil {
+		t.Fatalf("expected DeleteAADApplication to succeed, got: %v", err)
+	}
+
+	remaining, err := provider.ListApplicationsByDisplayName(context.Background(), "delete-me")
+	if err != nil {
+		t.Fatalf("unexpected error listing applications: %v", err)
+	}
+	if len(remaining) != 0 {
+		t.Fatalf("expected the application to be deleted, found %d remaining", len(remaining))
+	}
+}
+
+func TestDeleteAADApplicationMissingIsNoop(t *testing.T) {
+	provider := fake.NewProvider()
+	credMinter := newTestMinter(provider)
+	if err := credMinter.DeleteAADApplication(context.Background(), "does-not-exist"); err != nil {
+		t.Fatalf("expected deleting a missing application to be a no-op, got: %v", err)
+	}
+}
+
+func TestAddAndRemovePasswordCredential(t *testing.T) {
+	provider := fake.NewProvider()
+	app := models.NewApplication()
+	app.SetId(strPtr("app-1"))
+	app.SetDisplayName(strPtr("cred-app"))
+	provider.AddApplication(app)
+
+	credMinter := newTestMinter(provider)
+	secret, keyID, err := credMinter.AddPasswordCredential(context.Background(), "app-1", "cred-app", time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("expected AddPasswordCredential to succeed, got: %v", err)
+	}
+	if secret == "" || keyID == "" {
+		t.Fatal("expected a non-empty secret and keyID")
+	}
+
+	got, err := provider.GetApplication(context.Background(), "app-1")
+	if err != nil {
+		t.Fatalf("unexpected error fetching application: %v", err)
+	}
+	if len(got.GetPasswordCredentials()) != 1 {
+		t.Fatalf("expected 1 password credential after add, got %d", len(got.GetPasswordCredentials()))
+	}
+
+	if err := credMinter.RemovePasswordCredentialByKeyID(context.Background(), "app-1", keyID); err != nil {
+		t.Fatalf("expected RemovePasswordCredentialByKeyID to succeed, got: %v", err)
+	}
+
+	got, err = provider.GetApplication(context.Background(), "app-1")
+	if err != nil {
+		t.Fatalf("unexpected error fetching application: %v", err)
+	}
+	if len(got.GetPasswordCredentials()) != 0 {
+		t.Fatalf("expected 0 password credentials after remove, got %d", len(got.GetPasswordCredentials()))
+	}
+}
+
+// newExpiringCredential builds a password credential whose EndDateTime is
+// within the given duration, for seeding rotation scenarios.
+func newExpiringCredential(expiresIn time.Duration) models.PasswordCredentialable {
+	keyID := guuid.New()
+	credential := models.NewPasswordCredential()
+	credential.SetKeyId(&keyID)
+	endDateTime := time.Now().Add(expiresIn)
+	credential.SetEndDateTime(&endDateTime)
+	return credential
+}
+
+func TestRotateExpiringCredentials(t *testing.T) {
+	provider := fake.NewProvider()
+
+	app := models.NewApplication()
+	app.SetId(strPtr("app-1"))
+	app.SetDisplayName(strPtr("rotate-me"))
+	app.SetTags([]string{operatorOwnedTag})
+	app.SetPasswordCredentials([]models.PasswordCredentialable{newExpiringCredential(time.Hour)})
+	provider.AddApplication(app)
+
+	credMinter := newTestMinter(provider)
+	rotated, err := credMinter.RotateExpiringCredentials(context.Background(), 24*time.Hour)
+	if err != nil {
+		t.Fatalf("expected RotateExpiringCredentials to succeed, got: %v", err)
+	}
+	if len(rotated) != 1 {
+		t.Fatalf("expected 1 rotated credential, got %d", len(rotated))
+	}
+	if rotated[0].ApplicationDisplayName != "rotate-me" {
+		t.Fatalf("expected the rotated credential to belong to %q, got %q", "rotate-me", rotated[0].ApplicationDisplayName)
+	}
+	if rotated[0].SecretText == "" || rotated[0].KeyID == "" {
+		t.Fatal("expected a non-empty secret and keyID for the rotated credential")
+	}
+
+	got, err := provider.GetApplication(context.Background(), "app-1")
+	if err != nil {
+		t.Fatalf("unexpected error fetching application: %v", err)
+	}
+	keyIDs := passwordCredentialKeyIDs(got)
+	if len(keyIDs) != 1 || keyIDs[0] != rotated[0].KeyID {
+		t.Fatalf("expected the expiring credential to be replaced by the new one, got keyIDs %v", keyIDs)
+	}
+}
+
+// TestRotateExpiringCredentialsSkipsAppsNotOwnedByOperator proves
+// RotateExpiringCredentials only ever touches applications tagged as
+// operator-owned (operatorOwnedTag), not every application the fake
+// happens to hold, the same scoping graphAzureProvider.ListAllApplications
+// enforces in production via its tags/any() filter.
+func TestRotateExpiringCredentialsSkipsAppsNotOwnedByOperator(t *testing.T) {
+	provider := fake.NewProvider()
+
+	ownedApp := models.NewApplication()
+	ownedApp.SetId(strPtr("app-owned"))
+	ownedApp.SetDisplayName(strPtr("owned-app"))
+	ownedApp.SetTags([]string{operatorOwnedTag})
+	ownedApp.SetPasswordCredentials([]models.PasswordCredentialable{newExpiringCredential(time.Hour)})
+	provider.AddApplication(ownedApp)
+
+	foreignApp := models.NewApplication()
+	foreignApp.SetId(strPtr("app-foreign"))
+	foreignApp.SetDisplayName(strPtr("foreign-app"))
+	foreignApp.SetPasswordCredentials([]models.PasswordCredentialable{newExpiringCredential(time.Hour)})
+	provider.AddApplication(foreignApp)
+
+	credMinter := newTestMinter(provider)
+	rotated, err := credMinter.RotateExpiringCredentials(context.Background(), 24*time.Hour)
+	if err != nil {
+		t.Fatalf("expected RotateExpiringCredentials to succeed, got: %v", err)
+	}
+	if len(rotated) != 1 {
+		t.Fatalf("expected only the operator-owned application to be rotated, got %d rotated credential(s)", len(rotated))
+	}
+	if rotated[0].ApplicationID != "app-owned" {
+		t.Fatalf("expected the rotated application to be %q, got %q", "app-owned", rotated[0].ApplicationID)
+	}
+
+	foreign, err := provider.GetApplication(context.Background(), "app-foreign")
+	if err != nil {
+		t.Fatalf("unexpected error fetching application: %v", err)
+	}
+	if len(passwordCredentialKeyIDs(foreign)) != 1 {
+		t.Fatal("expected the non-operator-owned application's credential to be left untouched")
+	}
+}
+
+func strPtr(s string) *string {
+	return &s
+}
@@ -0,0 +1,74 @@
+package azure
+
+import (
+	"context"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/authorization/armauthorization"
+	"github.com/microsoftgraph/msgraph-sdk-go/models"
+)
+
+// AzureProvider abstracts the Microsoft Graph and ARM authorization
+// operations AzureCredentialsMinter needs in order to mint, assign roles to,
+// and delete AAD applications and service principals. Abstracting these
+// behind an interface lets the mint/delete/assign logic in minter.go be
+// exercised in tests against the fake implementation under azure/fake,
+// instead of requiring a live Azure tenant.
+//
+// azure/fake is a hand-written in-memory implementation, not a generated
+// mock: this tree has no mocking library (gomock, testify/mock, ...)
+// vendored, and a hand-rolled fake that models real create/list/delete
+// semantics exercises the retry and listing logic in minter.go more
+// faithfully than a call-and-return-recorder would. The fake does not page
+// its results, so graphAzureProvider's pagination is not exercised by it. That's a deliberate
+// substitution, not an oversight.
+//
+// The production implementation is graphAzureProvider, wired up by
+// newAzureCredentialsMinter. It is only used for the Microsoft Graph code
+// path; the deprecated useAADGraph fallback still talks to graphrbac
+// directly and is unaffected by this interface.
+type AzureProvider interface {
+	// CreateApplication creates a new AAD application with the given
+	// display name and initial password credential.
+	CreateApplication(ctx context.Context, displayName string, passwordCredential models.PasswordCredentialable) (*models.Application, error)
+	// GetApplication retrieves a single AAD application by object ID.
+	GetApplication(ctx context.Context, appObjectID string) (*models.Application, error)
+	// ListApplicationsByDisplayName returns every AAD application whose
+	// displayName matches exactly.
+	ListApplicationsByDisplayName(ctx context.Context, displayName string) ([]*models.Application, error)
+	// ListAllApplications returns every AAD application CCO owns (identified
+	// by the operatorOwnedTag applied at creation), across all result pages,
+	// used by RotateExpiringCredentials to find expiring credentials without
+	// touching applications CCO never created.
+	ListAllApplications(ctx context.Context) ([]*models.Application, error)
+	// DeleteApplication deletes the AAD application with the given object ID.
+	DeleteApplication(ctx context.Context, appObjectID string) error
+
+	// AddApplicationPassword adds a single password credential to an AAD
+	// application via Graph's atomic addPassword action, without touching
+	// any other credential already on the application.
+	AddApplicationPassword(ctx context.Context, appObjectID, displayName string, endDateTime time.Time) (secretText, keyID string, err error)
+	// RemoveApplicationPassword removes a single password credential from an
+	// AAD application via Graph's atomic removePassword action.
+	RemoveApplicationPassword(ctx context.Context, appObjectID, keyID string) error
+
+	// CreateServicePrincipal creates a service principal backed by appID.
+	CreateServicePrincipal(ctx context.Context, appID string) (*models.ServicePrincipal, error)
+	// GetServicePrincipalByAppID returns the service principal(s) backed by
+	// appID, if any exist.
+	GetServicePrincipalByAppID(ctx context.Context, appID string) ([]*models.ServicePrincipal, error)
+	// GetServicePrincipal retrieves a single service principal by its own
+	// ID, used to detect that a newly created service principal has
+	// replicated across AAD.
+	GetServicePrincipal(ctx context.Context, servicePrincipalID string) (*models.ServicePrincipal, error)
+
+	// CreateRoleAssignment creates a role assignment named name at scope,
+	// binding roleDefinitionID (a full resource ID) to principalID.
+	CreateRoleAssignment(ctx context.Context, scope, name, roleDefinitionID, principalID string) error
+	// ListRoleAssignmentsByPrincipal lists the role assignments at scope
+	// held by principalID, used to confirm a RoleAssignmentExists error
+	// refers to the assignment we wanted rather than a stale mismatched one.
+	ListRoleAssignmentsByPrincipal(ctx context.Context, scope, principalID string) ([]*armauthorization.RoleAssignment, error)
+	// ListRoleDefinitions returns the role definitions matching roleName.
+	ListRoleDefinitions(ctx context.Context, roleName string) ([]*armauthorization.RoleDefinition, error)
+}
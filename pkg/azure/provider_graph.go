@@ -0,0 +1,196 @@
+package azure
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/authorization/armauthorization"
+	"github.com/Azure/go-autorest/autorest/to"
+	guuid "github.com/google/uuid"
+	abstractions "github.com/microsoft/kiota-abstractions-go"
+	msgraphsdk "github.com/microsoftgraph/msgraph-sdk-go"
+	msgraphcore "github.com/microsoftgraph/msgraph-sdk-go-core"
+	"github.com/microsoftgraph/msgraph-sdk-go/applications"
+	"github.com/microsoftgraph/msgraph-sdk-go/models"
+	"github.com/microsoftgraph/msgraph-sdk-go/serviceprincipals"
+)
+
+// operatorOwnedTag marks every AAD application CCO creates. ListAllApplications
+// filters on it so RotateExpiringCredentials only ever considers applications
+// CCO itself minted, instead of every application in the tenant.
+const operatorOwnedTag = "owner=cloud-credential-operator"
+
+// graphAzureProvider is the production AzureProvider implementation, backed
+// by the Microsoft Graph SDK and the ARM authorization clients.
+type graphAzureProvider struct {
+	graphClient           *msgraphsdk.GraphServiceClient
+	requestAdapter        abstractions.RequestAdapter
+	roleAssignmentsClient *armauthorization.RoleAssignmentsClient
+	roleDefinitionClient  *armauthorization.RoleDefinitionsClient
+	subscriptionID        string
+}
+
+func (p *graphAzureProvider) CreateApplication(ctx context.Context, displayName string, passwordCredential models.PasswordCredentialable) (*models.Application, error) {
+	requestBody := models.NewApplication()
+	requestBody.SetDisplayName(to.StringPtr(displayName))
+	requestBody.SetPasswordCredentials([]models.PasswordCredentialable{passwordCredential})
+	requestBody.SetTags([]string{operatorOwnedTag})
+	return p.graphClient.Applications().Post(ctx, requestBody, nil)
+}
+
+func (p *graphAzureProvider) GetApplication(ctx context.Context, appObjectID string) (*models.Application, error) {
+	return p.graphClient.Applications().ByApplicationId(appObjectID).Get(ctx, nil)
+}
+
+func (p *graphAzureProvider) ListApplicationsByDisplayName(ctx context.Context, displayName string) ([]*models.Application, error) {
+	requestFilter := fmt.Sprintf("displayName eq '%v'", displayName)
+	resp, err := p.graphClient.Applications().Get(ctx, &applications.ApplicationsRequestBuilderGetRequestConfiguration{
+		QueryParameters: &applications.ApplicationsRequestBuilderGetQueryParameters{
+			Filter: &requestFilter,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return p.paginateApplications(ctx, resp)
+}
+
+// ListAllApplications returns every AAD application tagged as owned by the
+// operator (see operatorOwnedTag), walking every page of results rather than
+// just the first.
+func (p *graphAzureProvider) ListAllApplications(ctx context.Context) ([]*models.Application, error) {
+	requestFilter := fmt.Sprintf("tags/any(t:t eq '%s')", operatorOwnedTag)
+	resp, err := p.graphClient.Applications().Get(ctx, &applications.ApplicationsRequestBuilderGetRequestConfiguration{
+		QueryParameters: &applications.ApplicationsRequestBuilderGetQueryParameters{
+			Filter: &requestFilter,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return p.paginateApplications(ctx, resp)
+}
+
+// paginateApplications walks every page of an applications list response,
+// following Microsoft Graph's @odata.nextLink until exhausted, the same way
+// ListRoleDefinitions/ListRoleAssignmentsByPrincipal page through ARM results
+// below.
+func (p *graphAzureProvider) paginateApplications(ctx context.Context, resp models.ApplicationCollectionResponseable) ([]*models.Application, error) {
+	pageIterator, err := msgraphcore.NewPageIterator[*models.Application](resp, p.requestAdapter, models.CreateApplicationCollectionResponseFromDiscriminatorValue)
+	if err != nil {
+		return nil, err
+	}
+
+	var all []*models.Application
+	if err := pageIterator.Iterate(ctx, func(app *models.Application) bool {
+		all = append(all, app)
+		return true
+	}); err != nil {
+		return nil, err
+	}
+	return all, nil
+}
+
+func (p *graphAzureProvider) DeleteApplication(ctx context.Context, appObjectID string) error {
+	return p.graphClient.Applications().ByApplicationId(appObjectID).Delete(ctx, nil)
+}
+
+func (p *graphAzureProvider) AddApplicationPassword(ctx context.Context, appObjectID, displayName string, endDateTime time.Time) (string, string, error) {
+	requestBody := applications.NewItemAddPasswordRequestBuilderPostRequestBody()
+	passwordCredential := models.NewPasswordCredential()
+	passwordCredential.SetDisplayName(to.StringPtr(displayName))
+	passwordCredential.SetEndDateTime(&endDateTime)
+	requestBody.SetPasswordCredential(passwordCredential)
+
+	result, err := p.graphClient.Applications().ByApplicationId(appObjectID).AddPassword().Post(ctx, requestBody, nil)
+	if err != nil {
+		return "", "", err
+	}
+
+	var secretText, keyID string
+	if result.GetSecretText() != nil {
+		secretText = *result.GetSecretText()
+	}
+	if result.GetKeyId() != nil {
+		keyID = result.GetKeyId().String()
+	}
+	return secretText, keyID, nil
+}
+
+func (p *graphAzureProvider) RemoveApplicationPassword(ctx context.Context, appObjectID, keyID string) error {
+	parsedKeyID, err := guuid.Parse(keyID)
+	if err != nil {
+		return fmt.Errorf("invalid keyId %q: %v", keyID, err)
+	}
+
+	requestBody := applications.NewItemRemovePasswordRequestBuilderPostRequestBody()
+	requestBody.SetKeyId(&parsedKeyID)
+	return p.graphClient.Applications().ByApplicationId(appObjectID).RemovePassword().Post(ctx, requestBody, nil)
+}
+
+func (p *graphAzureProvider) CreateServicePrincipal(ctx context.Context, appID string) (*models.ServicePrincipal, error) {
+	requestBody := models.NewServicePrincipal()
+	requestBody.SetAppId(to.StringPtr(appID))
+	requestBody.SetAccountEnabled(to.BoolPtr(true))
+	return p.graphClient.ServicePrincipals().Post(ctx, requestBody, nil)
+}
+
+func (p *graphAzureProvider) GetServicePrincipalByAppID(ctx context.Context, appID string) ([]*models.ServicePrincipal, error) {
+	requestFilter := fmt.Sprintf("appId eq '%v'", appID)
+	resp, err := p.graphClient.ServicePrincipals().Get(ctx, &serviceprincipals.ServicePrincipalsRequestBuilderGetRequestConfiguration{
+		QueryParameters: &serviceprincipals.ServicePrincipalsRequestBuilderGetQueryParameters{
+			Filter: &requestFilter,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.GetValue(), nil
+}
+
+func (p *graphAzureProvider) GetServicePrincipal(ctx context.Context, servicePrincipalID string) (*models.ServicePrincipal, error) {
+	return p.graphClient.ServicePrincipals().ByServicePrincipalId(servicePrincipalID).Get(ctx, nil)
+}
+
+func (p *graphAzureProvider) CreateRoleAssignment(ctx context.Context, scope, name, roleDefinitionID, principalID string) error {
+	_, err := p.roleAssignmentsClient.Create(ctx, scope, name, armauthorization.RoleAssignmentCreateParameters{
+		Properties: &armauthorization.RoleAssignmentProperties{
+			RoleDefinitionID: &roleDefinitionID,
+			PrincipalID:      &principalID,
+		},
+	}, nil)
+	return err
+}
+
+func (p *graphAzureProvider) ListRoleAssignmentsByPrincipal(ctx context.Context, scope, principalID string) ([]*armauthorization.RoleAssignment, error) {
+	pager := p.roleAssignmentsClient.NewListForScopePager(scope, &armauthorization.RoleAssignmentsClientListForScopeOptions{
+		Filter: to.StringPtr(fmt.Sprintf("principalId eq '%s'", principalID)),
+	})
+
+	var roleAssignments []*armauthorization.RoleAssignment
+	for pager.More() {
+		page, err := pager.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		roleAssignments = append(roleAssignments, page.Value...)
+	}
+	return roleAssignments, nil
+}
+
+func (p *graphAzureProvider) ListRoleDefinitions(ctx context.Context, roleName string) ([]*armauthorization.RoleDefinition, error) {
+	pager := p.roleDefinitionClient.NewListPager("/", &armauthorization.RoleDefinitionsClientListOptions{
+		Filter: to.StringPtr(fmt.Sprintf("roleName eq '%v'", roleName)),
+	})
+
+	var roleDefinitions []*armauthorization.RoleDefinition
+	for pager.More() {
+		page, err := pager.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		roleDefinitions = append(roleDefinitions, page.Value...)
+	}
+	return roleDefinitions, nil
+}
@@ -0,0 +1,14 @@
+package azure
+
+// BuiltInRoles maps the commonly-used Azure built-in role names to their
+// stable role definition GUIDs, so CredentialsRequest specs can reference
+// AssignResourceScopedRoleByID with an ID that doesn't change across
+// locales or Azure API versions the way a roleName display-name lookup does.
+var BuiltInRoles = map[string]string{
+	"Owner":                       "8e3af657-a8ff-443c-a75c-2fe8c4bcb635",
+	"Contributor":                 "b24988ac-6180-42a0-ab88-20f7382dd24c",
+	"Reader":                      "acdd72a7-3385-48ef-bd42-f606fba81ae7",
+	"Virtual Machine Contributor": "9980e02c-c2be-4d73-94e8-173b1dc7cf3c",
+	"Network Contributor":         "4d97b98b-1d4f-4787-a291-c67834d212e7",
+	"Storage Account Contributor": "17d1049b-9a84-46fb-8f53-869881c3d3ab",
+}